@@ -4,37 +4,143 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"reflect"
+	"regexp"
 	"sync"
 
 	"github.com/chirino/graphql"
+	"github.com/chirino/graphql/query"
 	"github.com/chirino/graphql/schema"
 )
 
+// UpstreamLoad batches every request-time query document aimed at the same
+// upstream endpoint and operation type during one execution level into a
+// single round trip. Field resolvers register their own per-call document
+// with add() while the executor is still collecting the level's resolutions;
+// the first resolver to actually block on resolution() merges and dispatches
+// on behalf of all of them.
 type UpstreamLoad struct {
 	ctx        context.Context
-	upstream   *upstreamServer
+	upstream   *endpoint
 	selections []*schema.QueryDocument
 	variables  map[string]interface{}
 	merged     *schema.QueryDocument
 
+	mu       sync.Mutex
 	once     sync.Once
-	response *graphql.Response
+	resolved bool
+
+	response *graphql.EngineResponse
 }
 
-func (load *UpstreamLoad) resolution() (value reflect.Value, err error) {
-	// concurrent call to Do will wait for the first call to finish..
+var variableReferenceRegex = regexp.MustCompile(`\$([A-Za-z_][A-Za-z_0-9]*)`)
+
+// add registers a caller's upstream query document with the load, renaming
+// its variables so they can't collide with another caller's variables of the
+// same name once everything is merged, and returns the parsed document the
+// caller should keep around to unpack its own slice of the eventual merged
+// response (see extractResult).
+func (load *UpstreamLoad) add(queryText string, variables map[string]interface{}) (*schema.QueryDocument, error) {
+	load.mu.Lock()
+	defer load.mu.Unlock()
+
+	suffix := fmt.Sprintf("_%x", len(load.selections))
+	renamedText := variableReferenceRegex.ReplaceAllString(queryText, "$$${1}"+suffix)
+
+	doc, err := query.Parse(renamedText)
+	if err != nil {
+		return nil, err
+	}
+
+	if load.variables == nil {
+		load.variables = map[string]interface{}{}
+	}
+	for name, value := range variables {
+		load.variables[name+suffix] = value
+	}
+	// mergeQueryDocs merges into, and rewrites the selections of, the first
+	// document's operation, so the load gets its own copy of the operation
+	// and doc keeps the original selections extractResult reads back.
+	op := *doc.Operations[0]
+	load.selections = append(load.selections, &schema.QueryDocument{Operations: []*schema.Operation{&op}, Fragments: doc.Fragments})
+	return doc, nil
+}
+
+// resolution merges every document registered with the load and issues a
+// single upstream request. Concurrent calls block on the first one to finish.
+// The first call also closes the load's registration window (see resolved
+// and UpstreamLoads.get): the executor resolves one field at a time, so a
+// resolver that registers after this point is too late to share in this
+// round trip and must start a fresh one instead of reading this one's
+// response back for selections it never contributed.
+func (load *UpstreamLoad) resolution() *graphql.EngineResponse {
 	load.once.Do(func() {
-		load.response = load.upstream.client(&graphql.Request{
+		load.mu.Lock()
+		load.resolved = true
+		load.mu.Unlock()
+
+		load.merged = mergeQueryDocs(load.selections, load.variables, load.upstream.forwardDirectives)
+		// The merged operation is the first document's; declare every other
+		// caller's (renamed) variables on it as well.
+		for _, d := range load.selections[1:] {
+			mergedOp := load.merged.Operations[0]
+			mergedOp.Vars = append(mergedOp.Vars, d.Operations[0].Vars...)
+		}
+
+		onType := entryPointObject(load.upstream.schema, load.merged.Operations[0].Type)
+		if err := checkComplexity(load.upstream.schema, load.upstream.fieldComplexity, onType, load.upstream.info.MaxUpstreamComplexity, load.merged); err != nil {
+			load.response = &graphql.EngineResponse{Errors: []*graphql.Error{{Message: err.Error()}}}
+			return
+		}
+
+		load.response = load.upstream.client(&graphql.EngineRequest{
 			Context:   load.ctx,
 			Query:     load.merged.String(),
 			Variables: load.variables,
 		})
 	})
-	return reflect.Value{}, nil
+	return load.response
 }
 
-func mergeQueryDocs(docs []*schema.QueryDocument) *schema.QueryDocument {
+// extractResult walks a decoded merged response back into the shape the
+// caller's own (un-merged) selection document expects, using the
+// Alias/Extension bookkeeping mergeQuerySelections wrote onto each original
+// selection when it folded it into the merged document.
+func extractResult(data map[string]interface{}, selections schema.SelectionList) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, sel := range selections {
+		field, ok := sel.(*schema.FieldSelection)
+		if !ok {
+			continue
+		}
+		mergedAlias, _ := field.Extension.(string)
+		key := field.Alias.Text
+		if key == "" {
+			key = field.Name
+		}
+
+		value := data[mergedAlias]
+		if len(field.Selections) > 0 {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				value = extractResult(v, field.Selections)
+			case []interface{}:
+				mapped := make([]interface{}, len(v))
+				for i, item := range v {
+					if m, ok := item.(map[string]interface{}); ok {
+						mapped[i] = extractResult(m, field.Selections)
+					} else {
+						mapped[i] = item
+					}
+				}
+				value = mapped
+			}
+		}
+		out[key] = value
+	}
+	return out
+}
+
+func mergeQueryDocs(docs []*schema.QueryDocument, variables map[string]interface{}, forwardDirectives []string) *schema.QueryDocument {
 	toDoc := &schema.QueryDocument{}
 	operations := map[schema.OperationType]*schema.Operation{}
 
@@ -56,13 +162,19 @@ func mergeQueryDocs(docs []*schema.QueryDocument) *schema.QueryDocument {
 
 	var counter int32 = 0
 	for _, operation := range operations {
-		operation.Selections = mergeQuerySelections(toDoc, operation.Selections, &counter)
+		operation.Selections = mergeQuerySelections(toDoc, operation.Selections, &counter, variables, forwardDirectives)
 	}
 
 	return toDoc
 }
 
-func mergeQuerySelections(doc *schema.QueryDocument, from schema.SelectionList, counter *int32) schema.SelectionList {
+// mergeQuerySelections folds from's selections into as few upstream
+// selections as possible, assigning each kept field a synthetic f<N> alias
+// (recorded back onto the original selection's Extension so the caller can
+// later find its own slice of the merged response). @include/@skip are
+// evaluated against variables here, as the spec requires, and any other
+// directive is kept only if it's in forwardDirectives.
+func mergeQuerySelections(doc *schema.QueryDocument, from schema.SelectionList, counter *int32, variables map[string]interface{}, forwardDirectives []string) schema.SelectionList {
 
 	buf := &bytes.Buffer{}
 	idx := map[string]schema.Selection{}
@@ -71,9 +183,15 @@ func mergeQuerySelections(doc *schema.QueryDocument, from schema.SelectionList,
 	for _, sel := range from {
 		switch original := sel.(type) {
 		case *schema.FieldSelection:
+			if !evaluateIncludeSkip(original.Directives, variables) {
+				continue
+			}
+			original.Directives = forwardedDirectives(original.Directives, forwardDirectives)
+
 			buf.Reset()
 			buf.WriteString(original.Name)
 			original.Arguments.WriteTo(buf)
+			writeDirectiveKey(buf, original.Directives)
 			key := buf.String()
 
 			if existing, ok := idx[key]; !ok {
@@ -91,10 +209,15 @@ func mergeQuerySelections(doc *schema.QueryDocument, from schema.SelectionList,
 			}
 
 		case *schema.InlineFragment:
+			if !evaluateIncludeSkip(original.Directives, variables) {
+				continue
+			}
+			original.Directives = forwardedDirectives(original.Directives, forwardDirectives)
 
 			buf.Reset()
 			buf.WriteString("... on ")
 			original.On.WriteTo(buf)
+			writeDirectiveKey(buf, original.Directives)
 			key := buf.String()
 
 			if existing, ok := idx[key]; !ok {
@@ -102,14 +225,19 @@ func mergeQuerySelections(doc *schema.QueryDocument, from schema.SelectionList,
 				idx[key] = original
 			} else {
 				existing := existing.(*schema.InlineFragment)
-				existing.Selections = mergeQuerySelections(doc, original.Selections, counter)
+				existing.Selections = mergeQuerySelections(doc, original.Selections, counter, variables, forwardDirectives)
 			}
 
 		case *schema.FragmentSpread:
+			if !evaluateIncludeSkip(original.Directives, variables) {
+				continue
+			}
+			original.Directives = forwardedDirectives(original.Directives, forwardDirectives)
 
 			buf.Reset()
 			buf.WriteString("...")
 			buf.WriteString(original.Name)
+			writeDirectiveKey(buf, original.Directives)
 			key := buf.String()
 
 			if _, ok := idx[key]; !ok {
@@ -122,18 +250,121 @@ func mergeQuerySelections(doc *schema.QueryDocument, from schema.SelectionList,
 	for _, sel := range result {
 		switch sel := sel.(type) {
 		case *schema.FieldSelection:
-			sel.Selections = mergeQuerySelections(doc, sel.Selections, counter)
+			sel.Selections = mergeQuerySelections(doc, sel.Selections, counter, variables, forwardDirectives)
 		case *schema.InlineFragment:
-			sel.Selections = mergeQuerySelections(doc, sel.Selections, counter)
+			sel.Selections = mergeQuerySelections(doc, sel.Selections, counter, variables, forwardDirectives)
 		}
 	}
 	return result
 }
 
+func writeDirectiveKey(buf *bytes.Buffer, directives schema.DirectiveList) {
+	for _, d := range directives {
+		buf.WriteString("@")
+		buf.WriteString(d.Name)
+		d.Args.WriteTo(buf)
+	}
+}
+
+// evaluateIncludeSkip applies @include(if:)/@skip(if:) against variables,
+// per the GraphQL spec, regardless of whether either is in the forwarding
+// whitelist - they're always handled locally, never sent upstream.
+func evaluateIncludeSkip(directives schema.DirectiveList, variables map[string]interface{}) bool {
+	if d := directives.Get("include"); d != nil && !directiveBoolArg(d, variables, true) {
+		return false
+	}
+	if d := directives.Get("skip"); d != nil && directiveBoolArg(d, variables, false) {
+		return false
+	}
+	return true
+}
+
+func directiveBoolArg(d *schema.Directive, variables map[string]interface{}, defaultValue bool) bool {
+	arg := d.Args.Get("if")
+	if arg == nil {
+		return defaultValue
+	}
+	switch v := arg.Value.(type) {
+	case *schema.BasicLit:
+		return v.Text == "true"
+	case *schema.Variable:
+		if b, ok := variables[v.Name].(bool); ok {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+// forwardedDirectives drops @include/@skip (always handled locally above)
+// and anything not in the whitelist.
+func forwardedDirectives(directives schema.DirectiveList, whitelist []string) schema.DirectiveList {
+	if len(directives) == 0 || len(whitelist) == 0 {
+		return nil
+	}
+	allowed := map[string]bool{}
+	for _, name := range whitelist {
+		allowed[name] = true
+	}
+
+	var out schema.DirectiveList
+	for _, d := range directives {
+		if d.Name == "include" || d.Name == "skip" {
+			continue
+		}
+		if allowed[d.Name] {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
 type UpstreamLoads struct {
 	started bool
+	mu      sync.Mutex
 	loads   map[string]*UpstreamLoad
 }
 type UpstreamLoadsContextKeyType byte
 
 const UpstreamLoadsContextKey = UpstreamLoadsContextKeyType(0)
+
+// get returns the UpstreamLoad batching requests for the given upstream
+// endpoint and operation type within the current execution, creating it on
+// first use. A load that has already started resolving is retired and
+// replaced: the resolvers that reach it after that point (a nested field
+// under an already-resolving sibling, or a later element of a list) didn't
+// make it into that round trip's merged query, so handing them the already-
+// dispatched response back would have them read results for selections that
+// were never sent.
+func (loads *UpstreamLoads) get(ctx context.Context, key string, upstream *endpoint) *UpstreamLoad {
+	loads.mu.Lock()
+	defer loads.mu.Unlock()
+
+	if loads.loads == nil {
+		loads.loads = map[string]*UpstreamLoad{}
+	}
+	load := loads.loads[key]
+	if load != nil {
+		load.mu.Lock()
+		resolved := load.resolved
+		load.mu.Unlock()
+		if resolved {
+			load = nil
+		}
+	}
+	if load == nil {
+		load = &UpstreamLoad{ctx: ctx, upstream: upstream}
+		loads.loads[key] = load
+	}
+	return load
+}
+
+// UpstreamLoadsFromContext fetches the UpstreamLoads installed by New's
+// request middleware. It falls back to a throwaway instance so a caller that
+// bypasses the middleware (e.g. a direct, non-HTTP invocation) still gets
+// per-call batching rather than a nil pointer panic.
+func UpstreamLoadsFromContext(ctx context.Context) *UpstreamLoads {
+	if loads, ok := ctx.Value(UpstreamLoadsContextKey).(*UpstreamLoads); ok {
+		return loads
+	}
+	return &UpstreamLoads{loads: map[string]*UpstreamLoad{}}
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"strconv"
+
+	"github.com/chirino/graphql/qerrors"
+	"github.com/chirino/graphql/schema"
+)
+
+// complexityMultiplierArgs are the pagination-style arguments that scale a
+// field's cost by the amount of data it can return.
+var complexityMultiplierArgs = []string{"first", "last", "limit"}
+
+// complexityCost walks a query selection set rooted at onType, scoring each
+// field with its configured complexity (default 1) multiplied by any
+// first/last/limit integer argument found on it (default multiplier 1 when
+// absent) and, when the field has a sub-selection, by that sub-selection's
+// own cost, expanding fragment spreads and inline fragments in place. onType
+// may be an Object, Interface or Union: fragments under an Interface/Union
+// field are resolved to their actual condition type via s, so a
+// type-specific field reached only through an inline fragment or fragment
+// spread still gets costed instead of silently scoring zero.
+//
+// visiting holds the named fragments already being expanded along the
+// current recursion chain, so a self- or mutually-recursive fragment
+// (`fragment A on T { ...A }`) stops instead of recursing until the stack
+// overflows - this runs ahead of the engine's own validation, so it's the
+// only thing standing between a crafted request and a crash.
+func complexityCost(s *schema.Schema, fieldComplexity map[string]map[string]int, onType schema.NamedType, selections schema.SelectionList, fragments schema.FragmentList, visiting map[string]bool) int {
+	if onType == nil {
+		return 0
+	}
+
+	total := 0
+	for _, sel := range selections {
+		switch sel := sel.(type) {
+		case *schema.FieldSelection:
+			total += fieldComplexityCost(s, fieldComplexity, onType, sel, fragments, visiting)
+
+		case *schema.InlineFragment:
+			total += complexityCost(s, fieldComplexity, fragmentConditionType(s, onType, sel.On), sel.Selections, fragments, visiting)
+
+		case *schema.FragmentSpread:
+			if visiting[sel.Name] {
+				continue
+			}
+			frag := fragments.Get(sel.Name)
+			if frag == nil {
+				continue
+			}
+			visiting[sel.Name] = true
+			total += complexityCost(s, fieldComplexity, fragmentConditionType(s, onType, frag.On), frag.Selections, fragments, visiting)
+			delete(visiting, sel.Name)
+		}
+	}
+	return total
+}
+
+func fieldComplexityCost(s *schema.Schema, fieldComplexity map[string]map[string]int, onType schema.NamedType, sel *schema.FieldSelection, fragments schema.FragmentList, visiting map[string]bool) int {
+	if sel.Name == "__typename" {
+		return 0
+	}
+
+	field := typeFields(onType).Get(sel.Name)
+	if field == nil {
+		return 0
+	}
+
+	cost := 1
+	if byField, ok := fieldComplexity[onType.TypeName()]; ok {
+		if c, ok := byField[sel.Name]; ok {
+			cost = c
+		}
+	}
+	cost *= complexityMultiplier(sel.Arguments)
+
+	if childType, ok := schema.DeepestType(field.Type).(schema.NamedType); ok && len(sel.Selections) > 0 {
+		cost *= complexityCost(s, fieldComplexity, childType, sel.Selections, fragments, visiting)
+	}
+	return cost
+}
+
+// typeFields returns the selectable fields declared directly on onType, or
+// nil for a Union, which declares none of its own (every field on a union
+// selection set has to come through a type-specific fragment instead).
+func typeFields(onType schema.NamedType) schema.FieldList {
+	switch t := onType.(type) {
+	case *schema.Object:
+		return t.Fields
+	case *schema.Interface:
+		return t.Fields
+	default:
+		return nil
+	}
+}
+
+// fragmentConditionType resolves an inline fragment's or fragment spread's
+// type condition (e.g. "... on Cat") against s, falling back to onType when
+// the condition is empty or doesn't resolve - which keeps a same-type
+// fragment (the common case) cheap to handle without a schema lookup.
+func fragmentConditionType(s *schema.Schema, onType schema.NamedType, condition schema.TypeName) schema.NamedType {
+	if condition.Name == "" || s == nil {
+		return onType
+	}
+	if resolved, ok := s.Types[condition.Name]; ok {
+		return resolved
+	}
+	return onType
+}
+
+// complexityMultiplier returns the value of the first first/last/limit
+// argument that is a positive integer literal, or 1 if there is none.
+func complexityMultiplier(args schema.ArgumentList) int {
+	for _, name := range complexityMultiplierArgs {
+		arg := args.Get(name)
+		if arg == nil {
+			continue
+		}
+		lit, ok := arg.Value.(*schema.BasicLit)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(lit.Text); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// checkComplexity computes doc's complexity against onType and fails with a
+// qerrors.Error if it exceeds limit. limit <= 0 disables the check.
+func checkComplexity(s *schema.Schema, fieldComplexity map[string]map[string]int, onType *schema.Object, limit int, doc *schema.QueryDocument) error {
+	if limit <= 0 || onType == nil || len(doc.Operations) == 0 {
+		return nil
+	}
+
+	cost := complexityCost(s, fieldComplexity, onType, doc.Operations[0].Selections, doc.Fragments, map[string]bool{})
+	if cost > limit {
+		return qerrors.Errorf("query complexity %d exceeds the limit of %d", cost, limit)
+	}
+	return nil
+}
+
+// entryPointObject resolves the root object for an operation type (Query,
+// Mutation or Subscription) on s, if any.
+func entryPointObject(s *schema.Schema, opType schema.OperationType) *schema.Object {
+	t, _ := s.EntryPoints[opType].(*schema.Object)
+	return t
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chirino/graphql/query"
+	"github.com/chirino/graphql/schema"
+)
+
+func mustParseSchema(t *testing.T, text string) *schema.Schema {
+	t.Helper()
+	s, err := Parse(text)
+	if err != nil {
+		t.Fatalf("could not parse schema: %v", err)
+	}
+	return s
+}
+
+func mustParseQuery(t *testing.T, text string) *schema.QueryDocument {
+	t.Helper()
+	doc, err := query.Parse(text)
+	if err != nil {
+		t.Fatalf("could not parse query: %v", err)
+	}
+	return doc
+}
+
+func TestComplexityCost_NestedMultipliers(t *testing.T) {
+	s := mustParseSchema(t, `
+		schema { query: Query }
+		type Query {
+			items(first: Int): Item
+		}
+		type Item {
+			name: String
+			children(first: Int): Item
+		}
+	`)
+
+	doc := mustParseQuery(t, `{
+		items(first: 3) {
+			name
+			children(first: 2) {
+				name
+			}
+		}
+	}`)
+
+	onType := entryPointObject(s, schema.Query)
+	got := complexityCost(s, nil, onType, doc.Operations[0].Selections, doc.Fragments, map[string]bool{})
+
+	// items: cost 1 * multiplier 3 = 3, multiplied by its children's cost:
+	//   name: 1
+	//   children: cost 1 * multiplier 2 = 2, multiplied by its own child (name: 1) = 2
+	// children-of-items total = 1 + 2 = 3, so items = 3 * 3 = 9
+	want := 9
+	if got != want {
+		t.Fatalf("complexityCost = %d, want %d", got, want)
+	}
+
+	if err := checkComplexity(s, nil, onType, want, doc); err != nil {
+		t.Fatalf("checkComplexity with limit == cost should pass: %v", err)
+	}
+	if err := checkComplexity(s, nil, onType, want-1, doc); err == nil {
+		t.Fatalf("checkComplexity with limit < cost should fail")
+	}
+}
+
+func TestComplexityCost_FragmentsUnderInterfaceAndUnion(t *testing.T) {
+	s := mustParseSchema(t, `
+		schema { query: Query }
+		type Query {
+			node: Node
+			search: SearchResult
+		}
+		interface Node {
+			id: String
+		}
+		type Dog implements Node {
+			id: String
+			bone: String
+		}
+		type Cat implements Node {
+			id: String
+			toy: String
+		}
+		union SearchResult = Dog | Cat
+	`)
+
+	fieldComplexity := map[string]map[string]int{
+		"Dog": {"bone": 5},
+		"Cat": {"toy": 7},
+	}
+
+	doc := mustParseQuery(t, `{
+		node {
+			id
+			... on Dog {
+				bone
+			}
+		}
+		search {
+			...CatFields
+		}
+	}
+
+	fragment CatFields on Cat {
+		toy
+	}`)
+
+	onType := entryPointObject(s, schema.Query)
+	got := complexityCost(s, fieldComplexity, onType, doc.Operations[0].Selections, doc.Fragments, map[string]bool{})
+
+	// node: id (1) + inline fragment on Dog's bone (5) = 6
+	// search: fragment spread CatFields on Cat's toy (7) = 7
+	want := 13
+	if got != want {
+		t.Fatalf("complexityCost = %d, want %d - a field reached only through an inline "+
+			"fragment or fragment spread under an Interface/Union must still be costed", got, want)
+	}
+
+	if err := checkComplexity(s, fieldComplexity, onType, want-1, doc); err == nil {
+		t.Fatal("checkComplexity should reject a query over limit even though the expensive " +
+			"fields are only reachable through fragments under Interface/Union-typed fields")
+	}
+}
+
+func TestComplexityCost_RecursiveFragmentDoesNotHang(t *testing.T) {
+	s := mustParseSchema(t, `
+		schema { query: Query }
+		type Query {
+			item: Item
+		}
+		type Item {
+			name: String
+		}
+	`)
+
+	doc := mustParseQuery(t, `{
+		item {
+			...A
+		}
+	}
+
+	fragment A on Item {
+		name
+		...A
+	}`)
+
+	onType := entryPointObject(s, schema.Query)
+
+	done := make(chan int, 1)
+	go func() {
+		done <- complexityCost(s, nil, onType, doc.Operations[0].Selections, doc.Fragments, map[string]bool{})
+	}()
+
+	select {
+	case got := <-done:
+		// item: name (1), then the recursive ...A spread is skipped once its
+		// name is already being visited, so the cost stays finite.
+		if want := 1; got != want {
+			t.Fatalf("complexityCost = %d, want %d", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("complexityCost did not return - a self-referential fragment must not recurse forever")
+	}
+}
@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/chirino/graphql"
@@ -28,6 +30,21 @@ type EndpointInfo struct {
 	Prefix string `json:"prefix"`
 	Suffix string `json:"suffix"`
 	Schema string `json:"types"`
+
+	// SchemaFiles is a list of file globs, relative to ConfigDirectory, whose
+	// contents are concatenated (in sorted order) onto Schema to build this
+	// endpoint's SDL. Either or both of Schema and SchemaFiles may be used.
+	SchemaFiles []string `json:"schema-files"`
+
+	// Extend holds `extend type ...` SDL applied on top of the schema loaded
+	// from Schema/SchemaFiles or downloaded from the endpoint, before
+	// RenameTypes runs. Useful for patching a broken upstream schema without
+	// forking it.
+	Extend string `json:"extend"`
+
+	// MaxUpstreamComplexity caps the cost of the merged query the gateway is
+	// about to send to this endpoint. Zero means unlimited.
+	MaxUpstreamComplexity int `json:"max-upstream-complexity"`
 }
 
 type Field struct {
@@ -48,12 +65,36 @@ type Config struct {
 	EnabledSchemaStorage   bool                    `json:"enable-schema-storage"`
 	Endpoints              map[string]EndpointInfo `json:"endpoints"`
 	Types                  []TypeConfig            `json:"types"`
+
+	// ComplexityLimit caps the cost of a client request against the gateway's
+	// own schema, rejected before any upstream is contacted. Zero means
+	// unlimited.
+	ComplexityLimit int `json:"complexity-limit"`
+	// FieldComplexity gives the cost of an individual field, keyed by
+	// type name then field name. Fields not listed default to a cost of 1.
+	FieldComplexity map[string]map[string]int `json:"field-complexity"`
+
+	// ForwardDirectives whitelists directives (by name, without the leading
+	// "@") that survive request batching and get sent upstream as-is.
+	// @include/@skip are always evaluated locally against variables at merge
+	// time instead, per spec, regardless of whether they're listed here.
+	ForwardDirectives []string `json:"forward-directives"`
+
+	ServerConfig
 }
 
+// subscribeFunc opens a streaming connection to an upstream subscription
+// operation and returns a channel of incremental responses. The channel is
+// closed once the upstream stream ends or the request context is canceled.
+type subscribeFunc func(request *graphql.EngineRequest) (<-chan *graphql.EngineResponse, error)
+
 type endpoint struct {
-	client func(request *graphql.EngineRequest) *graphql.EngineResponse
-	schema *schema.Schema
-	info   EndpointInfo
+	client            func(request *graphql.EngineRequest) *graphql.EngineResponse
+	subscribe         subscribeFunc
+	schema            *schema.Schema
+	info              EndpointInfo
+	fieldComplexity   map[string]map[string]int
+	forwardDirectives []string
 }
 
 var validGraphQLIdentifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z_0-9]*$`)
@@ -73,9 +114,11 @@ func New(config Config) (*graphql.Engine, error) {
 schema {
     query: Query
     mutation: Mutation
+    subscription: Subscription
 }
 type Query {}
 type Mutation {}
+type Subscription {}
 `)
 
 	if err != nil {
@@ -83,13 +126,42 @@ type Mutation {}
 	}
 	root.Resolver = resolvers.List(root.Resolver, fieldResolver)
 
+	// Give every request its own batching scope so sibling field resolvers
+	// hitting the same upstream can be coalesced into one round trip by
+	// UpstreamLoad instead of fanning out N+1 calls.
+	root.RequestMiddleware = append(root.RequestMiddleware, func(request *graphql.Request, next func(request *graphql.Request) *graphql.Response) *graphql.Response {
+		request.Context = context.WithValue(request.Context, UpstreamLoadsContextKey, &UpstreamLoads{loads: map[string]*UpstreamLoad{}})
+		return next(request)
+	})
+
+	// Reject overly expensive client requests before any resolver, and
+	// therefore any upstream, ever runs.
+	if config.ComplexityLimit > 0 {
+		root.RequestMiddleware = append(root.RequestMiddleware, func(request *graphql.Request, next func(request *graphql.Request) *graphql.Response) *graphql.Response {
+			doc, err := query.Parse(request.Query)
+			if err != nil {
+				return &graphql.Response{Errors: []*graphql.Error{{Message: err.Error()}}}
+			}
+			if len(doc.Operations) > 0 {
+				onType := entryPointObject(root.Schema, doc.Operations[0].Type)
+				if err := checkComplexity(root.Schema, config.FieldComplexity, onType, config.ComplexityLimit, doc); err != nil {
+					return &graphql.Response{Errors: []*graphql.Error{{Message: err.Error()}}}
+				}
+			}
+			return next(request)
+		})
+	}
+
 	endpoints := map[string]*endpoint{}
 
 	for eid, info := range config.Endpoints {
 		c := relay.NewClient(info.URL)
 		endpoints[eid] = &endpoint{
-			info:   info,
-			client: c.ServeGraphQL,
+			info:              info,
+			client:            c.ServeGraphQL,
+			subscribe:         newWebSocketSubscriber(info.URL),
+			fieldComplexity:   config.FieldComplexity,
+			forwardDirectives: config.ForwardDirectives,
 		}
 	}
 
@@ -108,6 +180,20 @@ type Mutation {}
 		endpoints[eid].schema = s
 	}
 
+	// Advertise any forwarded directive whose definition we can find on one
+	// of the upstream schemas, so clients see it on the gateway's own schema.
+	for _, name := range config.ForwardDirectives {
+		if root.Schema.Directives[name] != nil {
+			continue
+		}
+		for _, endpoint := range endpoints {
+			if d := endpoint.schema.Directives[name]; d != nil {
+				root.Schema.Directives[name] = d
+				break
+			}
+		}
+	}
+
 	for _, typeConfig := range config.Types {
 		object := root.Schema.Types[typeConfig.Name]
 		if object == nil {
@@ -120,7 +206,7 @@ type Mutation {}
 					if fieldConfig.Description != "" {
 						field.Desc = &schema.Description{Text: fieldConfig.Description}
 					}
-					err := mount(root, object.Name, field, fieldResolver, endpoint.schema, endpoint.client, fieldConfig.Query)
+					err := mount(root, object.Name, field, fieldResolver, endpoint, fieldConfig.Query)
 					if err != nil {
 						return nil, err
 					}
@@ -137,10 +223,17 @@ type Mutation {}
 
 func loadEndpointSchema(config Config, eid string, endpoint *endpoint) (*schema.Schema, error) {
 
-	schemaText := endpoint.info.Schema
-	if strings.TrimSpace(schemaText) != "" {
+	sdl, sources, err := combinedSchemaText(config, endpoint.info)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(sdl) != "" {
 		log.Printf("using static schema for endpoint %s: %s", eid, endpoint.info.URL)
-		return Parse(schemaText)
+		s, err := Parse(sdl)
+		if err != nil {
+			return nil, locateSchemaError(err, sources)
+		}
+		return applySchemaExtensions(s, endpoint.info.Extend)
 	}
 
 	endpointSchemaFile := filepath.Join(config.ConfigDirectory, "endpoints", eid+".graphql")
@@ -169,7 +262,7 @@ func loadEndpointSchema(config Config, eid string, endpoint *endpoint) (*schema.
 			}
 		}
 
-		return s, nil
+		return applySchemaExtensions(s, endpoint.info.Extend)
 	}
 
 	if endpointSchemaFileExists {
@@ -179,12 +272,101 @@ func loadEndpointSchema(config Config, eid string, endpoint *endpoint) (*schema.
 		if err != nil {
 			return nil, err
 		}
-		return Parse(string(data))
+		s, err := Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return applySchemaExtensions(s, endpoint.info.Extend)
 	}
 
 	return nil, errors.Errorf("no schema defined for endpoint %s: %s", eid, endpoint.info.URL)
 }
 
+// schemaSource records where a span of lines in a combined SDL document came
+// from, so a parse error against the combined text can be blamed on the
+// right file.
+type schemaSource struct {
+	name      string
+	startLine int
+	lineCount int
+}
+
+// combinedSchemaText builds an endpoint's SDL from its literal Schema string
+// and/or every file matched by its SchemaFiles globs (resolved relative to
+// config.ConfigDirectory and read in stable sorted order).
+func combinedSchemaText(config Config, info EndpointInfo) (string, []schemaSource, error) {
+	buf := &bytes.Buffer{}
+	var sources []schemaSource
+
+	appendSource := func(name, text string) {
+		sources = append(sources, schemaSource{
+			name:      name,
+			startLine: strings.Count(buf.String(), "\n") + 1,
+			lineCount: strings.Count(text, "\n") + 1,
+		})
+		buf.WriteString(text)
+		buf.WriteString("\n")
+	}
+
+	if strings.TrimSpace(info.Schema) != "" {
+		appendSource("<inline schema>", info.Schema)
+	}
+
+	var files []string
+	for _, pattern := range info.SchemaFiles {
+		matches, err := filepath.Glob(filepath.Join(config.ConfigDirectory, pattern))
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "invalid schema-files pattern %q", pattern)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "could not read schema file %s", file)
+		}
+		appendSource(file, string(data))
+	}
+
+	return buf.String(), sources, nil
+}
+
+var lineNumberInErrorRegex = regexp.MustCompile(`line (\d+)`)
+
+// locateSchemaError rewrites a parse error against a combined SDL document
+// to reference the originating file and its own line number, when the error
+// text carries a line number we can map back through sources.
+func locateSchemaError(err error, sources []schemaSource) error {
+	m := lineNumberInErrorRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	line, convErr := strconv.Atoi(m[1])
+	if convErr != nil {
+		return err
+	}
+	for _, src := range sources {
+		if line >= src.startLine && line < src.startLine+src.lineCount {
+			return errors.Wrapf(err, "%s:%d", src.name, line-src.startLine+1)
+		}
+	}
+	return err
+}
+
+// applySchemaExtensions layers `extend type ...` SDL on top of an already
+// loaded schema, before RenameTypes runs.
+func applySchemaExtensions(s *schema.Schema, extend string) (*schema.Schema, error) {
+	if strings.TrimSpace(extend) == "" {
+		return s, nil
+	}
+	if err := s.Parse(extend); err != nil {
+		return nil, errors.Wrap(err, "could not apply schema extensions")
+	}
+	return s, nil
+}
+
 func Parse(schemaText string) (*schema.Schema, error) {
 	s := schema.New()
 	err := s.Parse(schemaText)
@@ -197,7 +379,9 @@ func Parse(schemaText string) (*schema.Schema, error) {
 var emptySelectionRegex = regexp.MustCompile(`{\s*}\s*$`)
 var querySplitter = regexp.MustCompile(`[}\s]*$`)
 
-func mount(gateway *graphql.Engine, mountTypeName string, mountField schema.Field, resolver resolvers.TypeAndFieldResolver, upstreamSchema *schema.Schema, serveGraphQL graphql.ServeGraphQLFunc, upstreamQuery string) error {
+func mount(gateway *graphql.Engine, mountTypeName string, mountField schema.Field, resolver resolvers.TypeAndFieldResolver, upstream *endpoint, upstreamQuery string) error {
+
+	upstreamSchema := upstream.schema
 
 	upstreamQueryDoc, qerr := query.Parse(upstreamQuery)
 	if qerr != nil {
@@ -236,7 +420,7 @@ func mount(gateway *graphql.Engine, mountTypeName string, mountField schema.Fiel
 		// Get all the field names from it and mount them...
 		for _, f := range upstreamResultType.Fields {
 			upstreamQuery = fmt.Sprintf("%s { %s } %s", queryHead, f.Name, queryTail)
-			err = mount(gateway, mountTypeName, *f, resolver, upstreamSchema, serveGraphQL, upstreamQuery)
+			err = mount(gateway, mountTypeName, *f, resolver, upstream, upstreamQuery)
 			if err != nil {
 				return err
 			}
@@ -309,35 +493,97 @@ func mount(gateway *graphql.Engine, mountTypeName string, mountField schema.Fiel
 		selectionAliases = append(selectionAliases, s.Selection.Alias.Text)
 	}
 
-	resolver.Set(mountTypeName, mountField.Name, func(request *resolvers.ResolveRequest, _ resolvers.Resolution) resolvers.Resolution {
-		return func() (reflect.Value, error) {
+	if mountTypeName == "Subscription" {
+		resolver.Set(mountTypeName, mountField.Name, func(request *resolvers.ResolveRequest, _ resolvers.Resolution) resolvers.Resolution {
+			return func() (reflect.Value, error) {
+
+				clientQuery := &bytes.Buffer{}
+				clientQuery.WriteString(queryHead)
+				request.Selection.Selections.WriteTo(clientQuery)
+				clientQuery.WriteString(queryTail)
+
+				query := clientQuery.String()
+				upstreamEvents, err := upstream.subscribe(&graphql.Request{
+					Context:   request.Context.GetContext(),
+					Query:     query,
+					Variables: request.Args,
+				})
+				if err != nil {
+					return reflect.Value{}, err
+				}
+
+				// The executor calls this Resolution exactly once, to start the
+				// subscription, and ignores the value it returns - every actual
+				// event is delivered out of band via FireSubscriptionEvent, from
+				// this goroutine, for as long as the upstream stream stays open.
+				go func() {
+					for result := range upstreamEvents {
+						if len(result.Errors) > 0 {
+							log.Println("subscription event failed: ", query)
+							request.ExecutionContext.FireSubscriptionEvent(reflect.Value{}, result.Error())
+							continue
+						}
+						data := map[string]interface{}{}
+						if err := json.Unmarshal(result.Data, &data); err != nil {
+							log.Println("could not decode subscription event: ", err)
+							continue
+						}
+						var r interface{} = data
+						for _, alias := range selectionAliases {
+							m, ok := r.(map[string]interface{})
+							if !ok {
+								r = nil
+								break
+							}
+							r = m[alias]
+						}
+						request.ExecutionContext.FireSubscriptionEvent(reflect.ValueOf(r), nil)
+					}
+					request.ExecutionContext.FireSubscriptionClose()
+				}()
+				return reflect.Value{}, nil
+			}
+		})
+		return nil
+	}
 
-			clientQuery := &bytes.Buffer{}
-			clientQuery.WriteString(queryHead)
+	loadKey := upstream.info.URL + "|" + string(upstreamOp.Type)
 
-			//request.Selection.Arguments.WriteTo(clientQuery)
-			request.Selection.Selections.WriteTo(clientQuery)
-			clientQuery.WriteString(queryTail)
+	resolver.Set(mountTypeName, mountField.Name, func(request *resolvers.ResolveRequest, _ resolvers.Resolution) resolvers.Resolution {
 
-			query := clientQuery.String()
-			result := serveGraphQL(&graphql.Request{
-				Context:   request.Context.GetContext(),
-				Query:     query,
-				Variables: request.Args,
-			})
+		clientQuery := &bytes.Buffer{}
+		clientQuery.WriteString(queryHead)
+
+		//request.Selection.Arguments.WriteTo(clientQuery)
+		request.Selection.Selections.WriteTo(clientQuery)
+		clientQuery.WriteString(queryTail)
+
+		// Register this call's query with the current request's batching
+		// scope now, while the executor is still collecting resolutions for
+		// this level, so everyone sharing an upstream+operation type gets
+		// merged into one round trip.
+		ctx := request.Context.GetContext()
+		loads := UpstreamLoadsFromContext(ctx)
+		load := loads.get(ctx, loadKey, upstream)
+		doc, err := load.add(clientQuery.String(), request.Args)
+		if err != nil {
+			return func() (reflect.Value, error) { return reflect.Value{}, err }
+		}
+
+		return func() (reflect.Value, error) {
+			result := load.resolution()
 
 			if len(result.Errors) > 0 {
-				log.Println("query failed: ", query)
+				log.Println("query failed: ", clientQuery.String())
 				return reflect.Value{}, result.Error()
 			}
 
 			data := map[string]interface{}{}
-			err := json.Unmarshal(result.Data, &data)
-			if err != nil {
+			if err := json.Unmarshal(result.Data, &data); err != nil {
 				return reflect.Value{}, err
 			}
 
-			var r interface{} = data
+			var r interface{} = extractResult(data, doc.Operations[0].Selections)
 			for _, alias := range selectionAliases {
 				if m, ok := r.(map[string]interface{}); ok {
 					r = m[alias]
@@ -0,0 +1,300 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chirino/graphql"
+	"github.com/gorilla/websocket"
+)
+
+// ServerConfig hosts a *graphql.Engine over HTTP with the kind of hardening
+// that's expected of an internet-facing gateway rather than a library used
+// from another Go program: CORS, virtual-host filtering and timeouts.
+type ServerConfig struct {
+	ListenAddr   string        `json:"listen-addr"`
+	CORSOrigins  []string      `json:"cors-origins"`
+	VirtualHosts []string      `json:"virtual-hosts"`
+	ReadTimeout  time.Duration `json:"read-timeout"`
+	WriteTimeout time.Duration `json:"write-timeout"`
+	IdleTimeout  time.Duration `json:"idle-timeout"`
+
+	// EnableGraphiQL serves the GraphiQL UI at /graphql/ui.
+	EnableGraphiQL bool `json:"enable-graphiql"`
+}
+
+// graphQLRequestBody is the wire shape of a client request, whether sent as
+// a POST body or assembled from GET query parameters.
+type graphQLRequestBody struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Serve mounts engine at /graphql and /graphql/ and listens on
+// config.ListenAddr until ctx is canceled, at which point it shuts down
+// gracefully.
+func Serve(ctx context.Context, engine *graphql.Engine, config ServerConfig) error {
+	mux := http.NewServeMux()
+
+	handler := graphQLHandler(engine, config)
+	mux.Handle("/graphql", handler)
+	mux.Handle("/graphql/", handler)
+	if config.EnableGraphiQL {
+		mux.HandleFunc("/graphql/ui", serveGraphiQL)
+	}
+
+	server := &http.Server{
+		Addr:         config.ListenAddr,
+		Handler:      mux,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+}
+
+func graphQLHandler(engine *graphql.Engine, config ServerConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !virtualHostAllowed(config.VirtualHosts, r.Host) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if websocket.IsWebSocketUpgrade(r) {
+			serveGraphQLWebSocket(engine, config, w, r)
+			return
+		}
+
+		if handleCORS(w, r, config.CORSOrigins) {
+			return
+		}
+
+		body, err := decodeGraphQLRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response := engine.ServeGraphQL(&graphql.Request{
+			Context:   r.Context(),
+			Query:     body.Query,
+			Variables: body.Variables,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// serveGraphQLWebSocket upgrades r to a graphql-ws connection and multiplexes
+// any number of concurrent operations - subscriptions in particular, since
+// engine.ServeGraphQL has no way to keep delivering events after its first
+// response - over it using the same graphqlWSMessage framing
+// wsSubscriptionClient speaks to upstreams in subscription.go.
+func serveGraphQLWebSocket(engine *graphql.Engine, config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"graphql-ws", "graphql-transport-ws"},
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || originAllowed(config.CORSOrigins, origin)
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(msg graphqlWSMessage) error {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	var mu sync.Mutex
+	cancels := map[string]context.CancelFunc{}
+	stopOp := func(id string) {
+		mu.Lock()
+		cancel := cancels[id]
+		delete(cancels, id)
+		mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	}
+	defer func() {
+		mu.Lock()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		msg := graphqlWSMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case gqlConnectionInit:
+			_ = write(graphqlWSMessage{Type: gqlConnectionAck})
+
+		case gqlStart:
+			body := &graphQLRequestBody{}
+			if err := json.Unmarshal(msg.Payload, body); err != nil {
+				continue
+			}
+
+			opCtx, cancel := context.WithCancel(r.Context())
+			mu.Lock()
+			cancels[msg.ID] = cancel
+			mu.Unlock()
+
+			id := msg.ID
+			go func() {
+				defer stopOp(id)
+				stream := engine.ServeGraphQLStream(&graphql.Request{
+					Context:   opCtx,
+					Query:     body.Query,
+					Variables: body.Variables,
+				})
+				for response := range stream {
+					payload, err := json.Marshal(response)
+					if err != nil {
+						continue
+					}
+					if err := write(graphqlWSMessage{ID: id, Type: gqlData, Payload: payload}); err != nil {
+						return
+					}
+				}
+				_ = write(graphqlWSMessage{ID: id, Type: gqlComplete})
+			}()
+
+		case gqlStop:
+			stopOp(msg.ID)
+		}
+	}
+}
+
+func decodeGraphQLRequest(r *http.Request) (*graphQLRequestBody, error) {
+	body := &graphQLRequestBody{}
+
+	if r.Method == http.MethodGet {
+		body.Query = r.URL.Query().Get("query")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &body.Variables); err != nil {
+				return nil, err
+			}
+		}
+		return body, nil
+	}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// handleCORS sets the CORS headers allowed by origins for r's Origin header
+// and, for a preflight OPTIONS request, writes the response itself. It
+// returns true when the caller should stop processing the request.
+func handleCORS(w http.ResponseWriter, r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin != "" && originAllowed(origins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Vary", "Origin")
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	if len(allowed) == 0 {
+		return false
+	}
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func virtualHostAllowed(allowed []string, host string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	for _, h := range allowed {
+		if h == "*" || h == host {
+			return true
+		}
+	}
+	return false
+}
+
+func serveGraphiQL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(graphiQLPage))
+}
+
+const graphiQLPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>GraphQL Link</title>
+  <link href="https://unpkg.com/graphiql/graphiql.min.css" rel="stylesheet" />
+</head>
+<body style="margin: 0;">
+  <div id="graphiql" style="height: 100vh;"></div>
+  <script src="https://unpkg.com/react/umd/react.production.min.js"></script>
+  <script src="https://unpkg.com/react-dom/umd/react-dom.production.min.js"></script>
+  <script src="https://unpkg.com/graphiql/graphiql.min.js"></script>
+  <script>
+    const fetcher = GraphiQL.createFetcher({ url: '/graphql' });
+    ReactDOM.render(
+      React.createElement(GraphiQL, { fetcher }),
+      document.getElementById('graphiql'),
+    );
+  </script>
+</body>
+</html>
+`
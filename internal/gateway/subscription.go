@@ -0,0 +1,256 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chirino/graphql"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// graphqlWSMessage is a single frame of the graphql-ws sub-protocol used to
+// multiplex many subscription operations over one upstream socket. Only the
+// graphql-ws message types below are handled; the graphql-transport-ws
+// message set (subscribe, next, ping, pong) is not, even when that
+// sub-protocol name is the one negotiated on the handshake.
+type graphqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+const (
+	gqlConnectionInit = "connection_init"
+	gqlConnectionAck  = "connection_ack"
+	gqlStart          = "start"
+	gqlData           = "data"
+	gqlError          = "error"
+	gqlComplete       = "complete"
+	gqlStop           = "stop"
+)
+
+// wsSubscriptionClient multiplexes subscription operations for a single
+// upstream endpoint over one graphql-ws connection, dialed lazily on the
+// first subscription request.
+type wsSubscriptionClient struct {
+	url string
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	pending map[string]*pendingSubscription
+	nextID  int64
+}
+
+// subscriptionDialer negotiates the graphql-ws/graphql-transport-ws
+// sub-protocol on the handshake, matching the Subprotocols the server side
+// (server.go's Upgrader) offers a connecting client.
+var subscriptionDialer = &websocket.Dialer{
+	Subprotocols: []string{"graphql-ws", "graphql-transport-ws"},
+}
+
+// pendingSubscription guards a single subscription's channel against the
+// send-after-close race between readLoop delivering an event and Subscribe's
+// context-watcher goroutine stopping the subscription concurrently: once
+// closed is set, send becomes a no-op instead of panicking on a closed
+// channel.
+type pendingSubscription struct {
+	mu     sync.Mutex
+	ch     chan *graphql.EngineResponse
+	closed bool
+}
+
+func (sub *pendingSubscription) send(response *graphql.EngineResponse) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.ch <- response
+}
+
+func (sub *pendingSubscription) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.ch)
+}
+
+// newWebSocketSubscriber builds a subscribeFunc for the given GraphQL HTTP(S)
+// endpoint URL, translated to its ws(s) equivalent for the graphql-ws
+// connection.
+func newWebSocketSubscriber(endpointURL string) subscribeFunc {
+	c := &wsSubscriptionClient{url: toWebSocketURL(endpointURL)}
+	return c.Subscribe
+}
+
+func toWebSocketURL(endpointURL string) string {
+	if strings.HasPrefix(endpointURL, "https://") {
+		return "wss://" + strings.TrimPrefix(endpointURL, "https://")
+	}
+	if strings.HasPrefix(endpointURL, "http://") {
+		return "ws://" + strings.TrimPrefix(endpointURL, "http://")
+	}
+	return endpointURL
+}
+
+func (c *wsSubscriptionClient) connect() (*websocket.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	if _, err := url.Parse(c.url); err != nil {
+		return nil, errors.Wrap(err, "invalid subscription endpoint")
+	}
+
+	conn, _, err := subscriptionDialer.Dial(c.url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to subscription endpoint")
+	}
+
+	init, err := json.Marshal(graphqlWSMessage{Type: gqlConnectionInit})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, init); err != nil {
+		return nil, errors.Wrap(err, "could not initialize subscription connection")
+	}
+
+	c.conn = conn
+	c.pending = map[string]*pendingSubscription{}
+	go c.readLoop(conn)
+	return conn, nil
+}
+
+func (c *wsSubscriptionClient) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			c.disconnect(conn)
+			c.closeAllPending()
+			return
+		}
+
+		msg := graphqlWSMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case gqlData:
+			c.deliver(msg.ID, func() *graphql.EngineResponse {
+				response := &graphql.EngineResponse{}
+				if err := json.Unmarshal(msg.Payload, response); err != nil {
+					return &graphql.EngineResponse{Errors: []*graphql.Error{{Message: err.Error()}}}
+				}
+				return response
+			}())
+		case gqlError:
+			c.deliver(msg.ID, &graphql.EngineResponse{Errors: []*graphql.Error{{Message: string(msg.Payload)}}})
+		case gqlComplete:
+			c.complete(msg.ID)
+		}
+	}
+}
+
+func (c *wsSubscriptionClient) deliver(id string, response *graphql.EngineResponse) {
+	c.mu.Lock()
+	sub := c.pending[id]
+	c.mu.Unlock()
+	if sub != nil {
+		sub.send(response)
+	}
+}
+
+func (c *wsSubscriptionClient) complete(id string) {
+	c.mu.Lock()
+	sub := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if sub != nil {
+		sub.close()
+	}
+}
+
+// disconnect clears conn so the next Subscribe call re-dials instead of
+// reusing a socket whose read loop has already exited.
+func (c *wsSubscriptionClient) disconnect(conn *websocket.Conn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *wsSubscriptionClient) closeAllPending() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = map[string]*pendingSubscription{}
+	c.mu.Unlock()
+	for _, sub := range pending {
+		sub.close()
+	}
+}
+
+// Subscribe starts a subscription operation and returns a channel fed with
+// one *graphql.EngineResponse per upstream event. The channel is closed when
+// the upstream sends a "complete" message, the socket is lost, or ctx is
+// canceled.
+func (c *wsSubscriptionClient) Subscribe(request *graphql.EngineRequest) (<-chan *graphql.EngineResponse, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	id := fmt.Sprintf("%d", atomic.AddInt64(&c.nextID, 1))
+	payload, err := json.Marshal(map[string]interface{}{
+		"query":     request.Query,
+		"variables": request.Variables,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *graphql.EngineResponse)
+	sub := &pendingSubscription{ch: ch}
+	c.mu.Lock()
+	c.pending[id] = sub
+	c.mu.Unlock()
+
+	start, err := json.Marshal(graphqlWSMessage{ID: id, Type: gqlStart, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, start); err != nil {
+		return nil, errors.Wrap(err, "could not start subscription")
+	}
+
+	ctx := request.Context
+	if ctx != nil {
+		go func() {
+			<-ctx.Done()
+			c.stop(conn, id)
+		}()
+	}
+
+	return ch, nil
+}
+
+func (c *wsSubscriptionClient) stop(conn *websocket.Conn, id string) {
+	stop, err := json.Marshal(graphqlWSMessage{ID: id, Type: gqlStop})
+	if err != nil {
+		return
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, stop)
+	c.complete(id)
+}